@@ -0,0 +1,60 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"github.com/bluesky-social/indigo/api/atproto"
+	"maunium.net/go/mautrix/bridgev2/commands"
+)
+
+var cmdSyncProfile = &commands.FullHandler{
+	Func: fnSyncProfile,
+	Name: "sync-profile",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdvanced,
+		Description: "Force-refresh a Bluesky ghost's profile (display name, avatar, handle).",
+		Args:        "<handle>",
+	},
+	RequiresLogin: true,
+}
+
+func fnSyncProfile(ce *commands.Event) {
+	if len(ce.Args) < 1 {
+		ce.Reply("Usage: `sync-profile <handle>`")
+		return
+	}
+	client, ok := ce.User.GetDefaultLogin().Client.(*BlueskyClient)
+	if !ok {
+		ce.Reply("This command requires a Bluesky login")
+		return
+	}
+	handle := ce.Args[0]
+	resp, err := atproto.IdentityResolveHandle(ce.Ctx, client.Client, handle)
+	if err != nil {
+		ce.Reply("Failed to resolve handle %s: %v", handle, err)
+		return
+	}
+	if err = client.syncGhost(ce.Ctx, resp.Did); err != nil {
+		ce.Reply("Failed to sync profile for %s: %v", handle, err)
+		return
+	}
+	ce.Reply("Synced profile for %s", handle)
+}
+
+func init() {
+	commands.RegisterDefault(cmdSyncProfile)
+}
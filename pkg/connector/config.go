@@ -0,0 +1,92 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"fmt"
+	"time"
+)
+
+// Config is the `bluesky` section of the bridge config file.
+type Config struct {
+	// MessageHandlingDeadline bounds how long HandleNewMessage and
+	// HandleMatrixMessage may spend on blob downloads, PDS calls, and
+	// Matrix uploads before the event is requeued instead of blocking
+	// the event loop indefinitely.
+	MessageHandlingDeadline Duration `yaml:"message_handling_deadline"`
+
+	// GhostProfileTTL controls how long a cached ghost profile (display
+	// name, avatar, handle) is considered fresh before syncGhost is
+	// called again for that sender.
+	GhostProfileTTL Duration `yaml:"ghost_profile_ttl"`
+}
+
+// Duration wraps time.Duration so it can be configured as a plain string
+// like "30s" in the YAML config, the same way the whatsmeow bridge does.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(any) error) error {
+	var raw string
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(raw)
+	if err != nil {
+		return fmt.Errorf("failed to parse duration %q: %w", raw, err)
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return d.Duration.String(), nil
+}
+
+const (
+	defaultMessageHandlingDeadline = 30 * time.Second
+	defaultGhostProfileTTL         = 24 * time.Hour
+)
+
+// UserLoginMetadata is the persisted per-login state for the Bluesky network
+// connector, stored as UserLogin.Metadata.
+type UserLoginMetadata struct {
+	// FirehoseCursor is the last atproto firehose sequence number this login
+	// has processed, so a bridge restart resumes the subscribeRepos stream
+	// from where it left off instead of replaying (or, depending on relay
+	// retention, dropping) everything that happened while it was down.
+	FirehoseCursor int64 `json:"firehose_cursor,omitempty"`
+}
+
+// messageHandlingDeadline returns the configured deadline, falling back to
+// defaultMessageHandlingDeadline if it wasn't set in the config.
+func (b *BlueskyClient) messageHandlingDeadline() time.Duration {
+	if b.Main == nil || b.Main.Config.MessageHandlingDeadline.Duration <= 0 {
+		return defaultMessageHandlingDeadline
+	}
+	return b.Main.Config.MessageHandlingDeadline.Duration
+}
+
+// ghostProfileTTL returns the configured ghost profile cache TTL, falling
+// back to defaultGhostProfileTTL if it wasn't set in the config.
+func (b *BlueskyClient) ghostProfileTTL() time.Duration {
+	if b.Main == nil || b.Main.Config.GhostProfileTTL.Duration <= 0 {
+		return defaultGhostProfileTTL
+	}
+	return b.Main.Config.GhostProfileTTL.Duration
+}
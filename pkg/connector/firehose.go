@@ -0,0 +1,413 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+)
+
+// FirehoseClient subscribes to the atproto firehose (com.atproto.sync.subscribeRepos)
+// and fans out post, profile, and follow record events for the logged-in
+// user and their followed accounts, independently of the DM convo log that
+// BlueskyClient polls via ConvoGetLog.
+type FirehoseClient struct {
+	Main   *BlueskyConnector
+	Client *BlueskyClient
+
+	relayHost string
+	cursor    int64
+	cursorMu  sync.Mutex
+
+	lastCursorPersist time.Time
+
+	stopLoop context.CancelFunc
+}
+
+// cursorPersistInterval bounds how often setCursor writes the cursor to the
+// login's metadata. subscribeRepos streams the entire network's commits
+// (hundreds+/sec, almost all irrelevant), so persisting on every single one
+// would hammer the database and serialize DB I/O into the repo stream's
+// single-threaded scheduler callback; persisting on this interval instead
+// bounds how much gets replayed after a crash to a few seconds' worth.
+const cursorPersistInterval = 10 * time.Second
+
+// NewFirehoseClient creates a firehose subsystem for the given user login,
+// resuming from the cursor persisted in the login's metadata (if any) so a
+// bridge restart doesn't always reconnect from scratch.
+func NewFirehoseClient(main *BlueskyConnector, client *BlueskyClient, relayHost string) *FirehoseClient {
+	f := &FirehoseClient{
+		Main:      main,
+		Client:    client,
+		relayHost: relayHost,
+	}
+	if meta, ok := client.UserLogin.Metadata.(*UserLoginMetadata); ok && meta != nil {
+		f.cursor = meta.FirehoseCursor
+	}
+	return f
+}
+
+// Start begins the reconnect-with-cursor subscribe loop in the background.
+// It returns once the first connection attempt has been dispatched.
+func (f *FirehoseClient) Start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	f.stopLoop = cancel
+	go f.subscribeLoop(ctx)
+}
+
+// Stop cancels the subscribe loop, if running.
+func (f *FirehoseClient) Stop() {
+	if f.stopLoop != nil {
+		f.stopLoop()
+	}
+}
+
+func (f *FirehoseClient) subscribeLoop(ctx context.Context) {
+	log := zerolog.Ctx(ctx).With().Str("component", "firehose").Logger()
+	backoff := time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		if err := f.connectOnce(ctx, &log); err != nil {
+			log.Err(err).Msg("Firehose connection failed, reconnecting")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (f *FirehoseClient) connectOnce(ctx context.Context, log *zerolog.Logger) error {
+	u := url.URL{
+		Scheme:   "wss",
+		Host:     f.relayHost,
+		Path:     "/xrpc/com.atproto.sync.subscribeRepos",
+		RawQuery: f.cursorQuery(),
+	}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), http.Header{})
+	if err != nil {
+		return fmt.Errorf("failed to dial firehose: %w", err)
+	}
+	defer conn.Close()
+	log.Info().Str("url", u.String()).Msg("Connected to firehose")
+
+	sched := sequential.NewScheduler("mautrix-bluesky", f.handleRepoCommit)
+	return events.HandleRepoStream(ctx, conn, sched)
+}
+
+func (f *FirehoseClient) cursorQuery() string {
+	f.cursorMu.Lock()
+	defer f.cursorMu.Unlock()
+	if f.cursor <= 0 {
+		return ""
+	}
+	return "cursor=" + strconv.FormatInt(f.cursor, 10)
+}
+
+func (f *FirehoseClient) setCursor(ctx context.Context, seq int64) {
+	f.cursorMu.Lock()
+	f.cursor = seq
+	due := time.Since(f.lastCursorPersist) >= cursorPersistInterval
+	if due {
+		f.lastCursorPersist = time.Now()
+	}
+	f.cursorMu.Unlock()
+
+	if !due {
+		return
+	}
+	if meta, ok := f.Client.UserLogin.Metadata.(*UserLoginMetadata); ok && meta != nil {
+		meta.FirehoseCursor = seq
+		if err := f.Client.UserLogin.Save(ctx); err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to persist firehose cursor")
+		}
+	}
+}
+
+// handleRepoCommit decodes a single firehose commit and dispatches any
+// post-create/delete, profile, or follow records it contains.
+func (f *FirehoseClient) handleRepoCommit(evt *atproto.SyncSubscribeRepos_Commit) error {
+	ctx := context.Background()
+	defer f.setCursor(ctx, evt.Seq)
+	if !f.isRelevant(evt.Repo) {
+		return nil
+	}
+
+	rr, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(evt.Blocks))
+	if err != nil {
+		return fmt.Errorf("failed to read repo CAR blocks: %w", err)
+	}
+
+	for _, op := range evt.Ops {
+		switch op.Action {
+		case "create", "update":
+			_, recBytes, err := rr.GetRecordBytes(ctx, op.Path)
+			if err != nil {
+				zerolog.Ctx(ctx).Err(err).Str("path", op.Path).Msg("Failed to load record from firehose commit")
+				continue
+			}
+			f.dispatchRecord(ctx, evt.Repo, op.Path, recBytes)
+		case "delete":
+			f.dispatchDelete(ctx, evt.Repo, op.Path)
+		}
+	}
+	return nil
+}
+
+func (f *FirehoseClient) isRelevant(repoDID string) bool {
+	return f.Client.isFollowedOrSelf(repoDID)
+}
+
+func (f *FirehoseClient) dispatchRecord(ctx context.Context, repoDID, path string, recBytes []byte) {
+	switch {
+	case hasCollectionPrefix(path, "app.bsky.feed.post"):
+		var post bsky.FeedPost
+		if err := post.UnmarshalCBOR(bytes.NewReader(recBytes)); err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to decode firehose post record")
+			return
+		}
+		f.Client.handleFeedPost(ctx, repoDID, path, &post)
+	case hasCollectionPrefix(path, "app.bsky.actor.profile"):
+		var profile bsky.ActorProfile
+		if err := profile.UnmarshalCBOR(bytes.NewReader(recBytes)); err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to decode firehose profile record")
+			return
+		}
+		f.Client.handleActorProfile(ctx, repoDID, &profile)
+	case hasCollectionPrefix(path, "app.bsky.graph.follow"):
+		var follow bsky.GraphFollow
+		if err := follow.UnmarshalCBOR(bytes.NewReader(recBytes)); err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to decode firehose follow record")
+			return
+		}
+		f.Client.handleGraphFollow(ctx, repoDID, &follow)
+	}
+}
+
+func (f *FirehoseClient) dispatchDelete(ctx context.Context, repoDID, path string) {
+	if hasCollectionPrefix(path, "app.bsky.feed.post") {
+		f.Client.handleFeedPostDelete(ctx, repoDID, path)
+	}
+}
+
+func hasCollectionPrefix(path, collection string) bool {
+	return len(path) > len(collection) && path[:len(collection)] == collection && path[len(collection)] == '/'
+}
+
+// isFollowedOrSelf reports whether repoDID belongs to the logged-in user or
+// one of the accounts they follow, i.e. whether its records should be
+// bridged into a feed portal at all.
+func (b *BlueskyClient) isFollowedOrSelf(repoDID string) bool {
+	if repoDID == b.UserLogin.ID.String() {
+		return true
+	}
+	return b.followedDIDs[repoDID]
+}
+
+// Connect starts the firehose subsystem as part of the login/connect
+// lifecycle, so it's running independently of the DM convo log even for a
+// user who never receives (or sends) a single DM. The follow backfill and
+// subscribe loop both run in the background so Connect itself returns
+// promptly instead of blocking on a potentially large paginated fetch.
+func (b *BlueskyClient) Connect(ctx context.Context) {
+	go b.ensureFirehoseStarted(context.WithoutCancel(ctx))
+}
+
+// Disconnect stops the firehose subsystem started by Connect and clears the
+// started flag, so logging out (or any other disconnect, not just process
+// shutdown) closes the websocket and its goroutine instead of leaking one
+// per login, and a later Connect on the same client actually restarts it
+// rather than permanently no-opping.
+func (b *BlueskyClient) Disconnect() {
+	b.firehoseMu.Lock()
+	firehose := b.firehose
+	b.firehose = nil
+	b.firehoseStarted = false
+	b.firehoseMu.Unlock()
+
+	if firehose != nil {
+		firehose.Stop()
+	}
+}
+
+// ensureFirehoseStarted backfills the follow list and starts the firehose
+// subscribe loop, unless it's already running. Disconnect clears the started
+// flag so a reconnect restarts the subsystem instead of permanently no-oping
+// after the first disconnect.
+func (b *BlueskyClient) ensureFirehoseStarted(ctx context.Context) {
+	b.firehoseMu.Lock()
+	if b.firehoseStarted {
+		b.firehoseMu.Unlock()
+		return
+	}
+	b.firehoseStarted = true
+	b.firehoseMu.Unlock()
+
+	if err := b.backfillFollows(ctx); err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to backfill follows before starting firehose")
+	}
+	firehose := NewFirehoseClient(b.Main, b, "bsky.network")
+
+	b.firehoseMu.Lock()
+	b.firehose = firehose
+	b.firehoseMu.Unlock()
+
+	firehose.Start(ctx)
+}
+
+// backfillFollows populates followedDIDs from app.bsky.graph.getFollows so
+// posts from accounts followed before the bridge started aren't filtered
+// out of the firehose until the user re-follows them.
+func (b *BlueskyClient) backfillFollows(ctx context.Context) error {
+	if b.followedDIDs == nil {
+		b.followedDIDs = make(map[string]bool)
+	}
+	selfDID := b.UserLogin.ID.String()
+	cursor := ""
+	for {
+		resp, err := bsky.GraphGetFollows(ctx, b.Client, selfDID, cursor, int64(100))
+		if err != nil {
+			return fmt.Errorf("failed to fetch follows: %w", err)
+		}
+		for _, follow := range resp.Follows {
+			b.followedDIDs[follow.Did] = true
+		}
+		if resp.Cursor == nil || *resp.Cursor == "" {
+			break
+		}
+		cursor = *resp.Cursor
+	}
+	return nil
+}
+
+// handleFeedPost bridges a firehose app.bsky.feed.post record into the feed
+// portal for its author, creating the portal on first post.
+func (b *BlueskyClient) handleFeedPost(ctx context.Context, authorDID, path string, post *bsky.FeedPost) {
+	portalKey := b.makeFeedPortalKey(authorDID)
+	sender, err := b.makeEventSender(authorDID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("author", authorDID).Msg("Failed to build event sender for firehose post")
+		return
+	}
+	// Use the post's own createdAt rather than time.Now(), so posts replayed
+	// from a reconnect cursor land at their true chronological position
+	// instead of all appearing to happen at reconnect time.
+	createdAt, err := syntax.ParseDatetimeTime(post.CreatedAt)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("author", authorDID).Str("created_at", post.CreatedAt).Msg("Failed to parse firehose post createdAt, falling back to now")
+		createdAt = time.Now()
+	}
+	b.UserLogin.QueueRemoteEvent(&simplevent.Message[any]{
+		EventMeta: simplevent.EventMeta{
+			Type: bridgev2.RemoteEventMessage,
+			LogContext: func(c zerolog.Context) zerolog.Context {
+				return c.Str("author", authorDID).Str("path", path)
+			},
+			PortalKey:    portalKey,
+			Sender:       sender,
+			CreatePortal: true,
+			Timestamp:    createdAt,
+			StreamOrder:  createdAt.UnixMilli(),
+		},
+		Data:               post,
+		ID:                 makeMessageID(makePortalID(string(portalKey.ID)), path),
+		ConvertMessageFunc: b.convertFeedPost,
+	})
+}
+
+// handleFeedPostDelete bridges a firehose feed.post deletion as a redaction
+// of the previously bridged message.
+func (b *BlueskyClient) handleFeedPostDelete(ctx context.Context, authorDID, path string) {
+	portalKey := b.makeFeedPortalKey(authorDID)
+	b.UserLogin.QueueRemoteEvent(&simplevent.MessageRemove{
+		EventMeta: simplevent.EventMeta{
+			Type:      bridgev2.RemoteEventMessageRemove,
+			PortalKey: portalKey,
+			Timestamp: time.Now(),
+		},
+		TargetMessage: makeMessageID(makePortalID(string(portalKey.ID)), path),
+	})
+}
+
+// convertFeedPost renders a bridged feed post as a single plain-text message
+// holding the post's text. Embeds attached to the post (images, links,
+// quotes) are not rendered.
+func (b *BlueskyClient) convertFeedPost(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data any) (*bridgev2.ConvertedMessage, error) {
+	post, ok := data.(*bsky.FeedPost)
+	if !ok {
+		return nil, fmt.Errorf("unexpected data type %T for feed post", data)
+	}
+	return &bridgev2.ConvertedMessage{
+		Parts: []*bridgev2.ConvertedMessagePart{{
+			Type:    event.EventMessage,
+			Content: &event.MessageEventContent{MsgType: event.MsgText, Body: post.Text},
+		}},
+	}, nil
+}
+
+// handleActorProfile refreshes the Matrix ghost for an actor.profile update
+// seen on the firehose.
+func (b *BlueskyClient) handleActorProfile(ctx context.Context, did string, profile *bsky.ActorProfile) {
+	if err := b.syncGhost(ctx, did); err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("did", did).Msg("Failed to sync ghost after firehose profile update")
+	}
+}
+
+// handleGraphFollow updates the set of followed DIDs whose posts should be
+// bridged into per-handle feed portals.
+func (b *BlueskyClient) handleGraphFollow(ctx context.Context, followerDID string, follow *bsky.GraphFollow) {
+	if followerDID != b.UserLogin.ID.String() {
+		return
+	}
+	if b.followedDIDs == nil {
+		b.followedDIDs = make(map[string]bool)
+	}
+	b.followedDIDs[follow.Subject] = true
+}
+
+// makeFeedPortalKey builds the portal key for the per-followed-handle feed
+// portal, distinct from the makePortalKey used for DM convos.
+func (b *BlueskyClient) makeFeedPortalKey(authorDID string) networkid.PortalKey {
+	return b.makePortalKey("feed-" + authorDID)
+}
@@ -0,0 +1,170 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+var (
+	lastGhostSync     = make(map[networkid.UserID]time.Time)
+	ghostSyncInFlight = make(map[networkid.UserID]bool)
+	lastGhostSyncMu   sync.Mutex
+)
+
+// syncGhost fetches the actor's profile from app.bsky.actor.getProfile and
+// updates the corresponding Matrix ghost's display name, avatar, and extra
+// profile info.
+func (b *BlueskyClient) syncGhost(ctx context.Context, did string) error {
+	profile, err := bsky.ActorGetProfile(ctx, b.Client, did)
+	if err != nil {
+		return fmt.Errorf("failed to fetch Bluesky profile for %s: %w", did, err)
+	}
+
+	ghost, err := b.UserLogin.Bridge.GetGhostByID(ctx, networkid.UserID(did))
+	if err != nil {
+		return fmt.Errorf("failed to get ghost for %s: %w", did, err)
+	}
+
+	name := profile.Handle
+	if profile.DisplayName != nil && *profile.DisplayName != "" {
+		name = *profile.DisplayName
+	}
+
+	extra := map[string]any{
+		"handle": profile.Handle,
+	}
+	if profile.Description != nil {
+		extra["description"] = *profile.Description
+	}
+	if profile.FollowersCount != nil {
+		extra["followers_count"] = *profile.FollowersCount
+	}
+
+	info := &bridgev2.UserInfo{
+		Name: &name,
+		ExtraUpdates: func(g *bridgev2.Ghost) bool {
+			g.Metadata.Extra = extra
+			return true
+		},
+	}
+	// profile.Avatar is the already-resolved CDN URL from profileViewDetailed,
+	// not a blob CID, so it's fetched with a plain HTTP GET rather than
+	// com.atproto.sync.getBlob. The URL itself is used as the avatar ID: it
+	// changes whenever the Bluesky-side avatar does, so it doubles as a
+	// cache key, and Get is only actually invoked by the framework when the
+	// ID changed, instead of this code re-downloading and reuploading the
+	// avatar on every syncGhost call regardless of whether it changed.
+	if profile.Avatar != nil && *profile.Avatar != "" {
+		avatarURL := *profile.Avatar
+		info.Avatar = &bridgev2.Avatar{
+			ID: networkid.AvatarID(avatarURL),
+			Get: func(ctx context.Context) ([]byte, error) {
+				return b.downloadAvatar(ctx, avatarURL)
+			},
+		}
+	}
+	err = ghost.UpdateInfo(ctx, info)
+	if err != nil {
+		return fmt.Errorf("failed to update ghost info for %s: %w", did, err)
+	}
+
+	lastGhostSyncMu.Lock()
+	lastGhostSync[networkid.UserID(did)] = time.Now()
+	pruneStaleGhostSyncEntries()
+	lastGhostSyncMu.Unlock()
+	return nil
+}
+
+// ghostSyncCacheLimit is the lastGhostSync size past which day-old entries
+// are pruned, so a long-running bridge doesn't keep every DID it has ever
+// synced. Entries synced within the last day are kept even past the limit.
+const ghostSyncCacheLimit = 10000
+
+// pruneStaleGhostSyncEntries evicts entries older than a day once the cache
+// grows past ghostSyncCacheLimit. Callers must hold lastGhostSyncMu.
+func pruneStaleGhostSyncEntries() {
+	if len(lastGhostSync) <= ghostSyncCacheLimit {
+		return
+	}
+	cutoff := time.Now().Add(-24 * time.Hour)
+	for did, last := range lastGhostSync {
+		if last.Before(cutoff) {
+			delete(lastGhostSync, did)
+		}
+	}
+}
+
+// downloadAvatar fetches a Bluesky CDN avatar URL's raw bytes for
+// bridgev2.Avatar.Get, letting the framework handle the Matrix media repo
+// upload and caching instead of this code doing it eagerly on every sync.
+func (b *BlueskyClient) downloadAvatar(ctx context.Context, avatarURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, avatarURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build avatar request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download avatar: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d downloading avatar", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read avatar response: %w", err)
+	}
+	return data, nil
+}
+
+// syncGhostIfStale calls syncGhost if the ghost's profile hasn't been synced
+// within ghostProfileTTL (or has never been synced), skipping the call if a
+// sync for the same DID is already in flight.
+func (b *BlueskyClient) syncGhostIfStale(ctx context.Context, did string) {
+	id := networkid.UserID(did)
+
+	lastGhostSyncMu.Lock()
+	last, ok := lastGhostSync[id]
+	fresh := ok && time.Since(last) < b.ghostProfileTTL()
+	if fresh || ghostSyncInFlight[id] {
+		lastGhostSyncMu.Unlock()
+		return
+	}
+	ghostSyncInFlight[id] = true
+	lastGhostSyncMu.Unlock()
+
+	defer func() {
+		lastGhostSyncMu.Lock()
+		delete(ghostSyncInFlight, id)
+		lastGhostSyncMu.Unlock()
+	}()
+
+	if err := b.syncGhost(ctx, did); err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("did", did).Msg("Failed to sync stale ghost profile")
+	}
+}
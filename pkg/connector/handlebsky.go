@@ -18,10 +18,13 @@ package connector
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"reflect"
+	"html"
+	"sync"
 	"time"
 
+	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/api/chat"
 	"github.com/bluesky-social/indigo/atproto/syntax"
@@ -41,11 +44,17 @@ func (b *BlueskyClient) HandleEvent(ctx context.Context, evt *chat.ConvoGetLog_O
 }
 
 func (b *BlueskyClient) HandleNewMessage(ctx context.Context, evt *chat.ConvoDefs_LogCreateMessage) {
+	ctx, cancel := context.WithTimeout(ctx, b.messageHandlingDeadline())
+	defer cancel()
+
 	sender, sentAt, msgID, msgData, err := b.parseMessageDetails(evt.Message.ConvoDefs_MessageView, evt.Message.ConvoDefs_DeletedMessageView)
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to parse message details")
 		return
 	}
+	// Run off the hot path: a profile fetch plus avatar upload shouldn't
+	// delay delivery of the message itself or eat into its own deadline.
+	go b.syncGhostIfStale(context.WithoutCancel(ctx), string(sender.Sender))
 	b.UserLogin.QueueRemoteEvent(&simplevent.Message[any]{
 		EventMeta: simplevent.EventMeta{
 			Type: bridgev2.RemoteEventMessage,
@@ -64,10 +73,81 @@ func (b *BlueskyClient) HandleNewMessage(ctx context.Context, evt *chat.ConvoDef
 		},
 		Data:               msgData,
 		ID:                 makeMessageID(makePortalID(evt.ConvoId), msgID),
-		ConvertMessageFunc: convertMessage,
+		ConvertMessageFunc: b.convertMessage,
 	})
 }
 
+// maxMessageHandlingRetries bounds how many times a message whose embed
+// conversion keeps timing out gets requeued, so a permanently-broken image
+// CID or a dead PDS eventually ends in a terminal failure notice instead of
+// hammering the PDS/Matrix media repo forever.
+const maxMessageHandlingRetries = 5
+
+var (
+	messageRetryCounts   = make(map[string]int)
+	messageRetryCountsMu sync.Mutex
+)
+
+// shouldGiveUpRetrying increments the retry count for msgID and reports
+// whether it has now exceeded maxMessageHandlingRetries. Once it gives up,
+// the count is reset so a later, unrelated timeout for the same message ID
+// (e.g. after a redelivery) starts counting fresh.
+func shouldGiveUpRetrying(msgID string) bool {
+	messageRetryCountsMu.Lock()
+	defer messageRetryCountsMu.Unlock()
+	messageRetryCounts[msgID]++
+	if messageRetryCounts[msgID] > maxMessageHandlingRetries {
+		delete(messageRetryCounts, msgID)
+		return true
+	}
+	return false
+}
+
+// clearRetryCount drops msgID's retry count, if any. Callers must call this
+// once a message that had previously timed out succeeds, so a message that
+// times out once and then succeeds on retry doesn't leave its counter in
+// the map for the rest of the bridge's lifetime.
+func clearRetryCount(msgID string) {
+	messageRetryCountsMu.Lock()
+	delete(messageRetryCounts, msgID)
+	messageRetryCountsMu.Unlock()
+}
+
+// requeueMessageView re-queues a message view whose embed conversion timed
+// out, so it gets retried instead of silently dropped with just a notice.
+// It's scheduled after a delay so a PDS/Matrix outage has a chance to clear
+// before the retry spends another deadline's worth of time on it.
+func (b *BlueskyClient) requeueMessageView(portal *bridgev2.Portal, msgView *chat.ConvoDefs_MessageView) {
+	go func() {
+		time.Sleep(b.messageHandlingDeadline())
+
+		sender, err := b.makeEventSender(msgView.Sender.Did)
+		if err != nil {
+			zerolog.Ctx(context.Background()).Err(err).Msg("Failed to requeue timed-out message")
+			return
+		}
+		sentAt, err := syntax.ParseDatetimeTime(msgView.SentAt)
+		if err != nil {
+			zerolog.Ctx(context.Background()).Err(err).Msg("Failed to requeue timed-out message")
+			return
+		}
+
+		b.UserLogin.QueueRemoteEvent(&simplevent.Message[any]{
+			EventMeta: simplevent.EventMeta{
+				Type:         bridgev2.RemoteEventMessage,
+				PortalKey:    portal.PortalKey,
+				Sender:       sender,
+				CreatePortal: true,
+				Timestamp:    sentAt,
+				StreamOrder:  sentAt.UnixMilli(),
+			},
+			Data:               msgView,
+			ID:                 makeMessageID(portal.PortalKey.ID, msgView.Id),
+			ConvertMessageFunc: b.convertMessage,
+		})
+	}()
+}
+
 func (b *BlueskyClient) parseMessageDetails(
 	msgView *chat.ConvoDefs_MessageView, deletedMsgView *chat.ConvoDefs_DeletedMessageView,
 ) (evtSender bridgev2.EventSender, sentAt time.Time, msgID string, msgData any, err error) {
@@ -99,7 +179,10 @@ func (b *BlueskyClient) parseMessageDetails(
 	return
 }
 
-func convertMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data any) (*bridgev2.ConvertedMessage, error) {
+func (b *BlueskyClient) convertMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data any) (*bridgev2.ConvertedMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.messageHandlingDeadline())
+	defer cancel()
+
 	switch typedData := any(data).(type) {
 	case *chat.ConvoDefs_MessageView:
 		parts := make([]*bridgev2.ConvertedMessagePart, 0)
@@ -111,10 +194,33 @@ func convertMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev
 			},
 		}
 		if typedData.Embed != nil {
-			// zerolog.Ctx(ctx).Debug().Any("embed", typedData.Embed.EmbedRecord_View.Record).Msg("embed")
-			embedPart, err := blueskyEmbedToMatrix(ctx, portal, intent, typedData.Embed.EmbedRecord_View.Record)
-			if err == nil {
-				parts = append(parts, embedPart)
+			embedParts, err := b.blueskyEmbedToMatrix(ctx, portal, intent, typedData.Sender.Did, typedData.Embed)
+			if errors.Is(err, context.DeadlineExceeded) {
+				if shouldGiveUpRetrying(typedData.Id) {
+					zerolog.Ctx(ctx).Warn().Str("message_id", typedData.Id).Msg("Giving up on embed conversion after repeated timeouts")
+					parts = append(parts, &bridgev2.ConvertedMessagePart{
+						Type: event.EventMessage,
+						Content: &event.MessageEventContent{
+							MsgType: event.MsgNotice,
+							Body:    "message handling timed out too many times — giving up",
+						},
+					})
+				} else {
+					zerolog.Ctx(ctx).Warn().Msg("Timed out converting embed, requeueing message for retry")
+					parts = append(parts, &bridgev2.ConvertedMessagePart{
+						Type: event.EventMessage,
+						Content: &event.MessageEventContent{
+							MsgType: event.MsgNotice,
+							Body:    "message handling timed out — will retry",
+						},
+					})
+					b.requeueMessageView(portal, typedData)
+				}
+			} else if err != nil {
+				zerolog.Ctx(ctx).Err(err).Msg("Failed to convert embed")
+			} else {
+				clearRetryCount(typedData.Id)
+				parts = append(parts, embedParts...)
 			}
 		}
 		if len(textPart.Content.Body) > 0 {
@@ -147,41 +253,219 @@ func convertMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev
 	}
 }
 
-func blueskyEmbedToMatrix(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, record any) (*bridgev2.ConvertedMessagePart, error) {
-	if record == nil {
-		zerolog.Ctx(ctx).Warn().Msg("Received nil record in blueskyEmbedToMatrix")
-		return nil, fmt.Errorf("record is nil")
+// blueskyEmbedToMatrix dispatches on the actual embed union the atproto
+// lexicons define and returns the converted parts for the embed (one per
+// image for image embeds), in the order they should be rendered (media
+// first, then any text/link preview or quote part).
+func (b *BlueskyClient) blueskyEmbedToMatrix(
+	ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, posterDID string, embed *chat.ConvoDefs_MessageView_Embed,
+) ([]*bridgev2.ConvertedMessagePart, error) {
+	switch {
+	case embed.EmbedImages_View != nil:
+		return b.imagesEmbedToMatrix(ctx, portal, intent, posterDID, embed.EmbedImages_View)
+	case embed.EmbedExternal_View != nil:
+		return []*bridgev2.ConvertedMessagePart{externalEmbedToMatrix(embed.EmbedExternal_View)}, nil
+	case embed.EmbedRecord_View != nil:
+		part, err := b.recordEmbedToMatrix(ctx, embed.EmbedRecord_View.Record)
+		if err != nil {
+			return nil, err
+		}
+		return []*bridgev2.ConvertedMessagePart{part}, nil
+	case embed.EmbedRecordWithMedia_View != nil:
+		mediaParts, err := b.recordWithMediaEmbedToMatrix(ctx, portal, intent, posterDID, embed.EmbedRecordWithMedia_View)
+		if err != nil {
+			return nil, err
+		}
+		return mediaParts, nil
+	default:
+		zerolog.Ctx(ctx).Warn().Any("embed", embed).Msg("Unhandled embed type in blueskyEmbedToMatrix")
+		return nil, fmt.Errorf("unhandled embed type")
 	}
+}
 
-	switch typedRecord := record.(type) {
-	case *bsky.EmbedRecord_View_Record:
-		content := event.MessageEventContent{
-			MsgType:       event.MsgText,
-			Body:          recordValueDecoder(ctx, typedRecord.EmbedRecord_ViewRecord.Value.Val),
-			FormattedBody: "https://bsky.app/profile/freya.bsky.social/post/3lfb7tow4642l\n<blockquote class=\"discord-embed\" background-color=\"#1185FE\"><p class=\"discord-embed-author\"><img data-mx-emoticon height=\"24\" src=\"https://cdn.bsky.app/img/feed_fullsize/plain/did:plc:5nq3pybl4nnoxfp3ovjy2lh7/bafkreicrukysn6lnd4nrl5nrkamt65hynzglq66obgjfsxyh5ybhnauhem@jpeg\" title=\"Author icon\" alt=\"\">&nbsp;<span><a href=\"https://bsky.app/profile/freya.bsky.social/post/3lfb7tow4642l\">Freya Holmér (@freya.bsky.social)</a></span></p><p class=\"discord-embed-description\"><p>all my kids are on bsky btw!!</p>\n<p>🐈‍⬛ @thor.acegikmo.com<br>\n🥗 @salad.acegikmo.com<br>\n🥪 @toast.acegikmo.com</p></p><table class=\"discord-embed-fields\"><tr><th>Likes</th></tr><tr><td>1037</td></tr></table><p class=\"discord-embed-image\"><img src=\"https://cdn.bsky.app/img/feed_fullsize/plain/did:plc:5nq3pybl4nnoxfp3ovjy2lh7/bafkreicrukysn6lnd4nrl5nrkamt65hynzglq66obgjfsxyh5ybhnauhem@jpeg\" alt=\"\" title=\"Embed image\"></p><p class=\"discord-embed-footer\"><sub><img data-mx-emoticon height=\"20\" src=\"https://cdn.bsky.app/img/feed_fullsize/plain/did:plc:5nq3pybl4nnoxfp3ovjy2lh7/bafkreicrukysn6lnd4nrl5nrkamt65hynzglq66obgjfsxyh5ybhnauhem@jpeg\" title=\"Footer icon\" alt=\"\">&nbsp;<span>Bluesky</span> • <time datetime=\"2025-01-08T22:33:27.859000+00:00\">Wednesday, 8 January 2025 22:33 UTC</time></sub></p></blockquote>",
-			Format:        event.FormatHTML,
+// imagesEmbedToMatrix downloads each image blob from the poster's PDS and
+// reuploads it to the Matrix media repo, emitting one m.image part per image.
+func (b *BlueskyClient) imagesEmbedToMatrix(
+	ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, posterDID string, images *bsky.EmbedImages_View,
+) ([]*bridgev2.ConvertedMessagePart, error) {
+	parts := make([]*bridgev2.ConvertedMessagePart, 0, len(images.Images))
+	for _, img := range images.Images {
+		data, err := atproto.SyncGetBlob(ctx, b.Client, img.Image.Ref.String(), posterDID)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return parts, fmt.Errorf("timed out downloading image blob: %w", err)
+			}
+			zerolog.Ctx(ctx).Err(err).Str("cid", img.Image.Ref.String()).Msg("Failed to download image blob")
+			continue
+		}
+		mxc, _, err := intent.UploadMedia(ctx, portal.MXID, data, img.Image.Ref.String(), img.Image.MimeType)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return parts, fmt.Errorf("timed out uploading image to Matrix: %w", err)
+			}
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to upload image to Matrix media repo")
+			continue
+		}
+		content := &event.MessageEventContent{
+			MsgType: event.MsgImage,
+			Body:    img.Alt,
+			URL:     mxc,
+			Info: &event.FileInfo{
+				MimeType: img.Image.MimeType,
+				Size:     int(img.Image.Size),
+			},
+		}
+		if img.AspectRatio != nil {
+			content.Info.Width = int(img.AspectRatio.Width)
+			content.Info.Height = int(img.AspectRatio.Height)
 		}
+		parts = append(parts, &bridgev2.ConvertedMessagePart{
+			Type:    event.EventMessage,
+			Content: content,
+		})
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("failed to convert any images in embed")
+	}
+	return parts, nil
+}
 
+// externalEmbedToMatrix renders an external link embed as a text part with a
+// beeper.link_previews URL preview, so clients that understand it can render
+// a real card instead of plain text.
+func externalEmbedToMatrix(external *bsky.EmbedExternal_View) *bridgev2.ConvertedMessagePart {
+	ext := external.External
+	content := &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    fmt.Sprintf("%s\n%s", ext.Title, ext.Uri),
+	}
+	preview := map[string]any{
+		"og:title":       ext.Title,
+		"og:description": ext.Description,
+		"og:url":         ext.Uri,
+	}
+	if ext.Thumb != nil {
+		preview["og:image"] = ext.Thumb.Ref.String()
+	}
+	return &bridgev2.ConvertedMessagePart{
+		Type:    event.EventMessage,
+		Content: content,
+		Extra: map[string]any{
+			"com.beeper.link_previews": []any{preview},
+		},
+	}
+}
+
+// recordEmbedToMatrix resolves a quoted record embed into an HTML blockquote
+// referencing the quoted post's author and text. recordNotFound and
+// recordBlocked views become a plain notice instead.
+func (b *BlueskyClient) recordEmbedToMatrix(ctx context.Context, record *bsky.EmbedRecord_View_Record) (*bridgev2.ConvertedMessagePart, error) {
+	switch {
+	case record.EmbedRecord_ViewRecord != nil:
+		view := record.EmbedRecord_ViewRecord
+		text := recordValueDecoder(ctx, view.Value.Val)
+		permalink := fmt.Sprintf("https://bsky.app/profile/%s/post/%s", view.Author.Did, rkeyFromURI(view.Uri))
+		body := fmt.Sprintf("%s\n> %s (@%s): %s", permalink, authorDisplayName(view.Author), view.Author.Handle, text)
+		// text, display name, and handle are all attacker-controlled (any
+		// Bluesky poster), so they must be escaped before going into HTML.
+		formatted := fmt.Sprintf(
+			`%s<br><blockquote><p><a href="%s">%s (@%s)</a></p><p>%s</p></blockquote>`,
+			permalink, permalink, html.EscapeString(authorDisplayName(view.Author)), html.EscapeString(view.Author.Handle), html.EscapeString(text),
+		)
 		return &bridgev2.ConvertedMessagePart{
-			Content: &content,
-			Type:    event.EventMessage,
+			Type: event.EventMessage,
+			Content: &event.MessageEventContent{
+				MsgType:       event.MsgText,
+				Body:          body,
+				FormattedBody: formatted,
+				Format:        event.FormatHTML,
+			},
+		}, nil
+	case record.EmbedRecord_ViewNotFound != nil:
+		return &bridgev2.ConvertedMessagePart{
+			Type: event.EventMessage,
+			Content: &event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body:    "Quoted post not found",
+			},
+		}, nil
+	case record.EmbedRecord_ViewBlocked != nil:
+		return &bridgev2.ConvertedMessagePart{
+			Type: event.EventMessage,
+			Content: &event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body:    "Quoted post is from a blocked account",
+			},
 		}, nil
-
 	default:
-		zerolog.Ctx(ctx).Warn().Any("record", record).Msg("Unhandled record type in blueskyEmbedToMatrix")
-		return nil, fmt.Errorf("unhandled record type: %T", record)
+		zerolog.Ctx(ctx).Warn().Any("record", record).Msg("Unhandled quoted record view in recordEmbedToMatrix")
+		return nil, fmt.Errorf("unhandled quoted record view")
 	}
 }
 
+// recordWithMediaEmbedToMatrix renders a quoted record alongside its
+// attached media, producing the media parts followed by the quote part.
+func (b *BlueskyClient) recordWithMediaEmbedToMatrix(
+	ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, posterDID string, embed *bsky.EmbedRecordWithMedia_View,
+) ([]*bridgev2.ConvertedMessagePart, error) {
+	var parts []*bridgev2.ConvertedMessagePart
+	switch {
+	case embed.Media.EmbedImages_View != nil:
+		mediaParts, err := b.imagesEmbedToMatrix(ctx, portal, intent, posterDID, embed.Media.EmbedImages_View)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return parts, err
+		} else if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to convert media in recordWithMedia embed")
+		} else {
+			parts = append(parts, mediaParts...)
+		}
+	case embed.Media.EmbedExternal_View != nil:
+		parts = append(parts, externalEmbedToMatrix(embed.Media.EmbedExternal_View))
+	}
+	recordPart, err := b.recordEmbedToMatrix(ctx, embed.Record.Record)
+	if err != nil {
+		return parts, err
+	}
+	return append(parts, recordPart), nil
+}
+
+func authorDisplayName(author *bsky.ActorDefs_ProfileViewBasic) string {
+	if author.DisplayName != nil && *author.DisplayName != "" {
+		return *author.DisplayName
+	}
+	return author.Handle
+}
+
+func rkeyFromURI(uri string) string {
+	for i := len(uri) - 1; i >= 0; i-- {
+		if uri[i] == '/' {
+			return uri[i+1:]
+		}
+	}
+	return uri
+}
+
 func recordValueDecoder(ctx context.Context, recordValue any) string {
-	zerolog.Ctx(ctx).Debug().Str("Concrete Type", reflect.TypeOf(recordValue).String()).Msg("Concrete Type of recordValue")
-	switch typedRecordValue := any(recordValue).(type) {
+	switch typedRecordValue := recordValue.(type) {
 	case *bsky.FeedPost:
-		zerolog.Ctx(ctx).Debug().Any("TYPE", typedRecordValue.Embed.EmbedImages.Images[0].Image.Ref.String()).Msg("TYPE")
 		return typedRecordValue.Text
+	case *bsky.FeedGenerator:
+		if typedRecordValue.Description != nil {
+			return fmt.Sprintf("Feed: %s — %s", typedRecordValue.DisplayName, *typedRecordValue.Description)
+		}
+		return fmt.Sprintf("Feed: %s", typedRecordValue.DisplayName)
+	case *bsky.GraphList:
+		if typedRecordValue.Description != nil {
+			return fmt.Sprintf("List: %s — %s", typedRecordValue.Name, *typedRecordValue.Description)
+		}
+		return fmt.Sprintf("List: %s", typedRecordValue.Name)
+	case *bsky.GraphStarterpack:
+		if typedRecordValue.Description != nil {
+			return fmt.Sprintf("Starter pack: %s — %s", typedRecordValue.Name, *typedRecordValue.Description)
+		}
+		return fmt.Sprintf("Starter pack: %s", typedRecordValue.Name)
 	default:
-		zerolog.Ctx(ctx).Debug().Any("TYPE", typedRecordValue).Msg("TYPE")
-		return "not parsed"
+		zerolog.Ctx(ctx).Debug().Any("value", typedRecordValue).Msg("Unhandled record type in recordValueDecoder")
+		return ""
 	}
-
 }
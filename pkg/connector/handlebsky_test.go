@@ -0,0 +1,93 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// TestRecordEmbedToMatrixEscapesHTML covers the HTML-escaping in
+// recordEmbedToMatrix: the quoted post's author display name, handle, and
+// text are all attacker-controlled (any Bluesky poster), so they must come
+// out of FormattedBody escaped rather than as raw HTML.
+func TestRecordEmbedToMatrixEscapesHTML(t *testing.T) {
+	displayName := `<script>alert(1)</script>`
+	record := &bsky.EmbedRecord_View_Record{
+		EmbedRecord_ViewRecord: &bsky.EmbedRecord_ViewRecord{
+			Uri: "at://did:plc:abc123/app.bsky.feed.post/xyz",
+			Author: &bsky.ActorDefs_ProfileViewBasic{
+				Did:         "did:plc:abc123",
+				Handle:      `h"<b>andle</b>`,
+				DisplayName: &displayName,
+			},
+			Value: &util.LexiconTypeDecoder{Val: &bsky.FeedPost{Text: `<img src=x onerror=alert(1)>`}},
+		},
+	}
+
+	b := &BlueskyClient{}
+	part, err := b.recordEmbedToMatrix(context.Background(), record)
+	if err != nil {
+		t.Fatalf("recordEmbedToMatrix returned error: %v", err)
+	}
+
+	formatted := part.Content.FormattedBody
+	for _, raw := range []string{"<script>", "<b>", "<img src=x"} {
+		if strings.Contains(formatted, raw) {
+			t.Errorf("FormattedBody contains unescaped %q:\n%s", raw, formatted)
+		}
+	}
+	for _, escaped := range []string{"&lt;script&gt;", "&lt;b&gt;", "&lt;img src=x"} {
+		if !strings.Contains(formatted, escaped) {
+			t.Errorf("FormattedBody missing expected escaped sequence %q:\n%s", escaped, formatted)
+		}
+	}
+}
+
+func TestRkeyFromURI(t *testing.T) {
+	cases := map[string]string{
+		"at://did:plc:abc123/app.bsky.feed.post/xyz789": "xyz789",
+		"xyz789": "xyz789",
+		"":       "",
+	}
+	for uri, want := range cases {
+		if got := rkeyFromURI(uri); got != want {
+			t.Errorf("rkeyFromURI(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
+
+func TestHasCollectionPrefix(t *testing.T) {
+	cases := []struct {
+		path, collection string
+		want             bool
+	}{
+		{"app.bsky.feed.post/abc123", "app.bsky.feed.post", true},
+		{"app.bsky.feed.post", "app.bsky.feed.post", false},
+		{"app.bsky.feed.postx/abc123", "app.bsky.feed.post", false},
+		{"app.bsky.actor.profile/self", "app.bsky.feed.post", false},
+	}
+	for _, c := range cases {
+		if got := hasCollectionPrefix(c.path, c.collection); got != c.want {
+			t.Errorf("hasCollectionPrefix(%q, %q) = %v, want %v", c.path, c.collection, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/api/chat"
+	"github.com/bluesky-social/indigo/lex/util"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+var (
+	_ bridgev2.MatrixMessageHandler = (*BlueskyClient)(nil)
+	_ bridgev2.RedactionHandler     = (*BlueskyClient)(nil)
+	_ bridgev2.ReadReceiptHandler   = (*BlueskyClient)(nil)
+)
+
+var (
+	mentionRegex  = regexp.MustCompile(`@([a-zA-Z0-9.-]+\.[a-zA-Z]{2,})`)
+	hashtagRegex  = regexp.MustCompile(`#(\w+)`)
+	htmlLinkRegex = regexp.MustCompile(`<a\s+[^>]*href="([^"]+)"[^>]*>(.*?)</a>`)
+)
+
+// HandleMatrixMessage translates an outgoing Matrix event into a
+// chat.bsky.convo.sendMessage call, uploading any attached media first.
+func (b *BlueskyClient) HandleMatrixMessage(ctx context.Context, msg *bridgev2.MatrixMessage) (*bridgev2.MatrixMessageResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.messageHandlingDeadline())
+	defer cancel()
+
+	convoID := string(msg.Portal.ID)
+	content := msg.Content
+
+	bodyText := content.Body
+	if msg.ReplyTo != nil {
+		// chat.bsky.convo messages have no reply-ref field (DMs aren't
+		// threaded the way feed posts are, so there's no AT-URI/CID to
+		// build a com.atproto.repo.strongRef from) — fold the reply
+		// context into the text instead of fabricating an invalid ref.
+		bodyText = quotePrefix(msg.ReplyTo.ID) + bodyText
+	}
+
+	newMsg := &chat.ConvoDefs_MessageInput{
+		Text: bodyText,
+	}
+
+	switch content.MsgType {
+	case event.MsgText, event.MsgEmote, event.MsgNotice:
+		// Facets are computed against bodyText (the string actually sent
+		// as newMsg.Text), using FormattedBody only to locate link anchors.
+		newMsg.Facets = b.extractFacets(ctx, bodyText, content.FormattedBody)
+	case event.MsgImage:
+		embed, err := b.uploadMatrixAttachment(ctx, content)
+		if err != nil {
+			return nil, b.handleOutboundTimeout(msg, fmt.Errorf("failed to upload attachment to Bluesky: %w", err))
+		}
+		newMsg.Embed = embed
+	case event.MsgVideo, event.MsgFile:
+		// chat.bsky.convo messages only have an image embed, no distinct
+		// video/file embed — rather than mislabeling these as images,
+		// reject them explicitly until Bluesky DMs support them natively.
+		return nil, fmt.Errorf("bluesky DMs don't support %s attachments", content.MsgType)
+	default:
+		return nil, fmt.Errorf("unsupported Matrix message type %q", content.MsgType)
+	}
+
+	resp, err := chat.ConvoSendMessage(ctx, b.Client, &chat.ConvoSendMessage_Input{
+		ConvoId: convoID,
+		Message: newMsg,
+	})
+	if err != nil {
+		return nil, b.handleOutboundTimeout(msg, fmt.Errorf("failed to send message to Bluesky: %w", err))
+	}
+	clearRetryCount(msg.Event.ID.String())
+
+	return &bridgev2.MatrixMessageResponse{
+		DB: &bridgev2.DatabaseMessageParams{
+			ID:        makeMessageID(msg.Portal.ID, resp.Id),
+			SenderID:  b.UserLogin.ID,
+			Timestamp: msg.Event.Timestamp.Time,
+		},
+	}, nil
+}
+
+// handleOutboundTimeout mirrors requeueMessageView on the inbound path for
+// the outbound direction: a deadline timeout schedules a retry of the whole
+// Matrix event (bounded by maxMessageHandlingRetries) instead of dropping it
+// silently, and the returned error says whether it'll retry or gave up. Any
+// non-timeout error is returned unchanged.
+func (b *BlueskyClient) handleOutboundTimeout(msg *bridgev2.MatrixMessage, err error) error {
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	msgID := msg.Event.ID.String()
+	if shouldGiveUpRetrying(msgID) {
+		return fmt.Errorf("message handling timed out too many times — giving up: %w", err)
+	}
+	b.requeueMatrixMessage(msg)
+	return fmt.Errorf("message handling timed out — will retry: %w", err)
+}
+
+// requeueMatrixMessage retries an outbound Matrix event whose handling timed
+// out, after a delay so a PDS/Matrix outage has a chance to clear before the
+// retry spends another deadline's worth of time on it.
+func (b *BlueskyClient) requeueMatrixMessage(msg *bridgev2.MatrixMessage) {
+	go func() {
+		time.Sleep(b.messageHandlingDeadline())
+		if _, err := b.HandleMatrixMessage(context.Background(), msg); err != nil {
+			zerolog.Ctx(context.Background()).Err(err).Msg("Failed to requeue timed-out outbound message")
+		}
+	}()
+}
+
+// HandleMatrixMessageRemove maps a Matrix redaction to
+// chat.bsky.convo.deleteMessageForSelf, which is the closest equivalent
+// Bluesky DMs expose (there is no remote delete-for-everyone).
+func (b *BlueskyClient) HandleMatrixMessageRemove(ctx context.Context, msg *bridgev2.MatrixMessageRemove) error {
+	convoID := string(msg.Portal.ID)
+	_, err := chat.ConvoDeleteMessageForSelf(ctx, b.Client, &chat.ConvoDeleteMessageForSelf_Input{
+		ConvoId:   convoID,
+		MessageId: parseMessageID(msg.TargetMessage.ID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete message on Bluesky: %w", err)
+	}
+	return nil
+}
+
+// HandleMatrixReadReceipt forwards a Matrix read receipt as
+// chat.bsky.convo.updateRead, marking the convo read up to the given message.
+func (b *BlueskyClient) HandleMatrixReadReceipt(ctx context.Context, receipt *bridgev2.MatrixReadReceipt) error {
+	if receipt.ExactMessage == nil {
+		return nil
+	}
+	convoID := string(receipt.Portal.ID)
+	_, err := chat.ConvoUpdateRead(ctx, b.Client, &chat.ConvoUpdateRead_Input{
+		ConvoId:   convoID,
+		MessageId: parseMessageID(receipt.ExactMessage.ID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update read state on Bluesky: %w", err)
+	}
+	return nil
+}
+
+// extractFacets parses @mentions and #hashtags directly out of body (the
+// exact string sent as newMsg.Text, so byte offsets line up), resolving
+// mention handles to DIDs via identity.resolveHandle. Links are parsed out
+// of the HTML formattedBody (plain-text bodies carry no anchors) and then
+// located inside body by their visible anchor text to get a valid offset.
+func (b *BlueskyClient) extractFacets(ctx context.Context, body, formattedBody string) []*bsky.RichtextFacet {
+	var facets []*bsky.RichtextFacet
+	for _, match := range mentionRegex.FindAllStringSubmatchIndex(body, -1) {
+		handle := body[match[2]:match[3]]
+		did, err := b.resolveMentionDID(ctx, handle)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Str("handle", handle).Msg("Failed to resolve mention handle to DID, dropping facet")
+			continue
+		}
+		facets = append(facets, &bsky.RichtextFacet{
+			Index: &bsky.RichtextFacet_ByteSlice{ByteStart: int64(match[0]), ByteEnd: int64(match[1])},
+			Features: []*bsky.RichtextFacet_Features_Elem{{
+				RichtextFacet_Mention: &bsky.RichtextFacet_Mention{Did: did},
+			}},
+		})
+	}
+	for _, match := range hashtagRegex.FindAllStringIndex(body, -1) {
+		facets = append(facets, &bsky.RichtextFacet{
+			Index: &bsky.RichtextFacet_ByteSlice{ByteStart: int64(match[0]), ByteEnd: int64(match[1])},
+			Features: []*bsky.RichtextFacet_Features_Elem{{
+				RichtextFacet_Tag: &bsky.RichtextFacet_Tag{Tag: strings.TrimPrefix(body[match[0]:match[1]], "#")},
+			}},
+		})
+	}
+	// searchFrom tracks how far into body the previous anchor match was
+	// found, so two links sharing the same visible anchor text (e.g. the
+	// same URL pasted twice) resolve to their own occurrence instead of
+	// both matching the first one.
+	searchFrom := 0
+	for _, match := range htmlLinkRegex.FindAllStringSubmatch(formattedBody, -1) {
+		uri, anchorText := match[1], match[2]
+		if anchorText == "" {
+			continue
+		}
+		rel := strings.Index(body[searchFrom:], anchorText)
+		if rel < 0 {
+			continue
+		}
+		idx := searchFrom + rel
+		searchFrom = idx + len(anchorText)
+		facets = append(facets, &bsky.RichtextFacet{
+			Index: &bsky.RichtextFacet_ByteSlice{ByteStart: int64(idx), ByteEnd: int64(idx + len(anchorText))},
+			Features: []*bsky.RichtextFacet_Features_Elem{{
+				RichtextFacet_Link: &bsky.RichtextFacet_Link{Uri: uri},
+			}},
+		})
+	}
+	return facets
+}
+
+// resolveMentionDID resolves a Matrix-parsed @handle to the DID the
+// app.bsky.richtext.facet#mention lexicon requires.
+func (b *BlueskyClient) resolveMentionDID(ctx context.Context, handle string) (string, error) {
+	resp, err := atproto.IdentityResolveHandle(ctx, b.Client, handle)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve handle %s: %w", handle, err)
+	}
+	return resp.Did, nil
+}
+
+// quotePrefix renders a short reply-context line to prepend to the message
+// text, since chat.bsky.convo messages have no native reply-ref field.
+func quotePrefix(replyToID networkid.MessageID) string {
+	return fmt.Sprintf("↩️ replying to %s\n", parseMessageID(replyToID))
+}
+
+// uploadMatrixAttachment downloads a Matrix media event and reuploads it to
+// the user's PDS as a blob, returning the embed to attach to the DM.
+func (b *BlueskyClient) uploadMatrixAttachment(ctx context.Context, content *event.MessageEventContent) (*chat.ConvoDefs_MessageInput_Embed, error) {
+	data, err := b.UserLogin.Bridge.Matrix.DownloadMedia(ctx, content.URL, content.File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download attachment from Matrix: %w", err)
+	}
+	mimeType := content.GetInfo().MimeType
+	resp, err := atproto.RepoUploadBlob(ctx, b.Client, &util.LexBlob{Data: data, MimeType: mimeType})
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload blob to Bluesky PDS: %w", err)
+	}
+	return &chat.ConvoDefs_MessageInput_Embed{
+		EmbedImages: &bsky.EmbedImages{
+			Images: []*bsky.EmbedImages_Image{{
+				Image: resp.Blob,
+				Alt:   content.Body,
+			}},
+		},
+	}, nil
+}
+
+// parseMessageID extracts the Bluesky-side message ID from a bridge
+// networkid.MessageID, which makeMessageID builds as "<portalID>:<msgID>".
+func parseMessageID(id networkid.MessageID) string {
+	_, msgID, _ := strings.Cut(string(id), ":")
+	return msgID
+}
@@ -0,0 +1,99 @@
+// mautrix-bluesky - A Matrix-Bluesky puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+func facetByteRange(t *testing.T, facet *bsky.RichtextFacet) (int64, int64) {
+	t.Helper()
+	idx, ok := facet.Index.(*bsky.RichtextFacet_ByteSlice)
+	if !ok {
+		t.Fatalf("facet index has unexpected type %T", facet.Index)
+	}
+	return idx.ByteStart, idx.ByteEnd
+}
+
+func TestExtractFacetsHashtags(t *testing.T) {
+	b := &BlueskyClient{}
+	body := "hello #world and #world2 too"
+
+	facets := b.extractFacets(context.Background(), body, "")
+	if len(facets) != 2 {
+		t.Fatalf("expected 2 facets, got %d", len(facets))
+	}
+	for i, want := range []string{"#world", "#world2"} {
+		start, end := facetByteRange(t, facets[i])
+		if got := body[start:end]; got != want {
+			t.Errorf("facet %d: got %q at [%d:%d], want %q", i, got, start, end, want)
+		}
+	}
+}
+
+// TestExtractFacetsDuplicateAnchorText covers the case where the same
+// visible anchor text appears more than once in the formatted body: each
+// occurrence must resolve to its own offset in body, not all match the
+// first occurrence of the anchor text.
+func TestExtractFacetsDuplicateAnchorText(t *testing.T) {
+	b := &BlueskyClient{}
+	body := "click here and also here"
+	formattedBody := `click <a href="https://example.com/first">here</a> and also <a href="https://example.com/second">here</a>`
+
+	facets := b.extractFacets(context.Background(), body, formattedBody)
+	if len(facets) != 2 {
+		t.Fatalf("expected 2 link facets, got %d", len(facets))
+	}
+
+	firstStart, firstEnd := facetByteRange(t, facets[0])
+	secondStart, secondEnd := facetByteRange(t, facets[1])
+
+	firstWant := int64(len("click "))
+	if firstStart != firstWant || body[firstStart:firstEnd] != "here" {
+		t.Errorf("first facet at [%d:%d] = %q, want start %d covering \"here\"", firstStart, firstEnd, body[firstStart:firstEnd], firstWant)
+	}
+	secondWant := int64(len("click here and also "))
+	if secondStart != secondWant || body[secondStart:secondEnd] != "here" {
+		t.Errorf("second facet at [%d:%d] = %q, want start %d covering \"here\"", secondStart, secondEnd, body[secondStart:secondEnd], secondWant)
+	}
+	if secondStart <= firstStart {
+		t.Errorf("second facet offset %d did not advance past first facet offset %d", secondStart, firstStart)
+	}
+
+	firstLink := facets[0].Features[0].RichtextFacet_Link
+	secondLink := facets[1].Features[0].RichtextFacet_Link
+	if firstLink == nil || secondLink == nil {
+		t.Fatalf("expected both facets to carry a link feature")
+	}
+	if firstLink.Uri != "https://example.com/first" || secondLink.Uri != "https://example.com/second" {
+		t.Errorf("got link URIs %q, %q, want https://example.com/first, https://example.com/second", firstLink.Uri, secondLink.Uri)
+	}
+}
+
+func TestExtractFacetsNoAnchorMatch(t *testing.T) {
+	b := &BlueskyClient{}
+	body := "no links here"
+	formattedBody := `<a href="https://example.com">this text isn't in body</a>`
+
+	facets := b.extractFacets(context.Background(), body, formattedBody)
+	if len(facets) != 0 {
+		t.Fatalf("expected no facets when the anchor text doesn't appear in body, got %d", len(facets))
+	}
+}